@@ -0,0 +1,125 @@
+package main
+
+// A small REST surface under /api/ that lets an operator UI or CI job
+// drive sextant instead of only fetching rendered cloud-configs: list
+// hosts, pull a given host's rendered config, and read back the CAs
+// and tokens the secrets store has generated for a cluster. Every
+// route is gated by --api-token; requests without a matching
+// "Authorization: Bearer <token>" header are denied with 403 and
+// logged.
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/k8sp/sextant/cloud-config-server/secrets"
+	cctemplate "github.com/k8sp/sextant/cloud-config-server/template"
+	"github.com/topicai/candy"
+	"gopkg.in/yaml.v2"
+)
+
+// hostSummary is what /api/hosts lists for each node.
+type hostSummary struct {
+	Hostname string `json:"hostname" yaml:"hostname"`
+	Mac      string `json:"mac" yaml:"mac"`
+	IP       string `json:"ip" yaml:"ip"`
+	Group    string `json:"group,omitempty" yaml:"group,omitempty"`
+}
+
+// registerAPIRoutes wires the /api/ surface onto router, gated by
+// apiToken. If apiToken is empty the API is not registered at all, so
+// operators who don't pass --api-token get no admin surface by
+// default.
+func registerAPIRoutes(router *mux.Router, clusterDescFile, ccTemplateDir, hostTemplateDir string, store secrets.Store, apiToken string) {
+	if apiToken == "" {
+		return
+	}
+	api := router.PathPrefix("/api/").Subrouter()
+	api.HandleFunc("/hosts", requireAPIToken(apiToken, makeHostsHandler(clusterDescFile)))
+	api.HandleFunc("/hosts/{name}/config", requireAPIToken(apiToken, makeHostConfigHandler(clusterDescFile, ccTemplateDir, hostTemplateDir, store)))
+	api.HandleFunc("/clusters/{name}/cas", requireAPIToken(apiToken, makeClusterCAsHandler(store)))
+	api.HandleFunc("/clusters/{name}/tokens", requireAPIToken(apiToken, makeClusterTokensHandler(store)))
+}
+
+// requireAPIToken denies requests whose Authorization header isn't
+// exactly "Bearer <apiToken>" with a logged 403.
+func requireAPIToken(apiToken string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiToken == "" || r.Header.Get("Authorization") != "Bearer "+apiToken {
+			glog.Warningf("denied %s %s: missing or wrong API token", r.Method, r.URL.Path)
+			http.Error(w, "missing or wrong API token", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeAPIResponse marshals v as YAML when the client's Accept header
+// asks for application/yaml, and as JSON otherwise.
+func writeAPIResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if strings.Contains(r.Header.Get("Accept"), "application/yaml") {
+		b, err := yaml.Marshal(v)
+		candy.Must(err)
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(b)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	candy.Must(json.NewEncoder(w).Encode(v))
+}
+
+// makeHostsHandler lists every node in clusterDescFile.
+func makeHostsHandler(clusterDescFile string) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		c, err := loadCluster(clusterDescFile)
+		candy.Must(err)
+		hosts := make([]hostSummary, 0, len(c.Nodes))
+		for _, n := range c.Nodes {
+			hosts = append(hosts, hostSummary{Hostname: n.Hostname, Mac: n.Mac(), IP: n.IP, Group: n.Group})
+		}
+		writeAPIResponse(w, r, hosts)
+	})
+}
+
+// makeHostConfigHandler renders the cloud-config for the node whose
+// hostname matches the {name} path variable.
+func makeHostConfigHandler(clusterDescFile, ccTemplateDir, hostTemplateDir string, store secrets.Store) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		c, err := loadCluster(clusterDescFile)
+		candy.Must(err)
+		n, ok := c.NodeByHostname(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var cc bytes.Buffer
+		candy.Must(cctemplate.Execute(&cc, n.Mac(), "cc-template", ccTemplateDir, clusterDescFile, hostTemplateDir, store))
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(cc.Bytes())
+	})
+}
+
+// makeClusterCAsHandler lists the CA certs already generated for the
+// {name} cluster namespace in the secrets store.
+func makeClusterCAsHandler(store secrets.Store) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		cas, err := store.ListCACerts(mux.Vars(r)["name"])
+		candy.Must(err)
+		writeAPIResponse(w, r, cas)
+	})
+}
+
+// makeClusterTokensHandler lists the tokens already generated for the
+// {name} cluster namespace in the secrets store.
+func makeClusterTokensHandler(store secrets.Store) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		tokens, err := store.ListTokens(mux.Vars(r)["name"])
+		candy.Must(err)
+		writeAPIResponse(w, r, tokens)
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPITokenDeniesMissingOrWrongToken(t *testing.T) {
+	called := false
+	h := requireAPIToken("s3cr3t", func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	for _, authHeader := range []string{"", "Bearer", "Bearer wrong", "Bearer s3cr3tx"} {
+		called = false
+		req := httptest.NewRequest(http.MethodGet, "/api/hosts", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		rr := httptest.NewRecorder()
+		h(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("Authorization=%q: got status %d, want %d", authHeader, rr.Code, http.StatusForbidden)
+		}
+		if called {
+			t.Errorf("Authorization=%q: handler was called despite missing/wrong token", authHeader)
+		}
+	}
+}
+
+func TestRequireAPITokenAllowsMatchingToken(t *testing.T) {
+	called := false
+	h := requireAPIToken("s3cr3t", func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	req := httptest.NewRequest(http.MethodGet, "/api/hosts", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rr := httptest.NewRecorder()
+	h(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if !called {
+		t.Error("handler was not called despite a matching token")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+// Boot artifact handlers let sextant serve the full PXE/iPXE and
+// removable-media install flow from one binary: an iPXE script that
+// chainloads the per-node kernel/initrd, the kernel and initrd
+// themselves, and an on-the-fly hybrid ISO that bundles both together
+// with the rendered cloud-config.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/k8sp/sextant/cloud-config-server/cache"
+	"github.com/k8sp/sextant/cloud-config-server/clusterdesc"
+	"github.com/k8sp/sextant/cloud-config-server/secrets"
+	cctemplate "github.com/k8sp/sextant/cloud-config-server/template"
+	"github.com/topicai/candy"
+	"gopkg.in/yaml.v2"
+)
+
+var ipxeScriptTmpl = template.Must(template.New("ipxe").Parse(`#!ipxe
+kernel {{.KernelURL}} {{.KernelArgs}}
+initrd {{.InitrdURL}}
+boot
+`))
+
+var grubCfgTmpl = template.Must(template.New("grub.cfg").Parse(`set timeout=0
+menuentry "sextant" {
+  linux /vmlinuz {{.KernelArgs}} cloud-config-url=/config.yaml
+  initrd /initrd.img
+}
+`))
+
+// bootNode bundles the lookup results a boot-artifact handler needs:
+// the matched node and the kernel/initrd image it declares.
+type bootNode struct {
+	Node       clusterdesc.Node
+	KernelPath string
+	InitrdPath string
+}
+
+// loadCluster parses clusterDescFile the same way validation() does.
+func loadCluster(clusterDescFile string) (*clusterdesc.Cluster, error) {
+	b, err := ioutil.ReadFile(clusterDescFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &clusterdesc.Cluster{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// resolveBootNode finds the node matching mac and its kernel/initrd
+// files under imageDir/<node.Image>/.
+func resolveBootNode(clusterDescFile, imageDir, mac string) (*bootNode, error) {
+	c, err := loadCluster(clusterDescFile)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := c.NodeByMac(mac)
+	if !ok {
+		return nil, fmt.Errorf("no node with mac %s in %s", mac, clusterDescFile)
+	}
+	dir := filepath.Join(imageDir, n.Image)
+	return &bootNode{
+		Node:       *n,
+		KernelPath: filepath.Join(dir, "vmlinuz"),
+		InitrdPath: filepath.Join(dir, "initrd.img"),
+	}, nil
+}
+
+// makeIPXEHandler renders the iPXE boot script for the node matching
+// the MAC in the URL, pointing it at the /kernel and /initrd
+// endpoints below.
+func makeIPXEHandler(clusterDescFile, imageDir string) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		mac := strings.ToLower(mux.Vars(r)["mac"])
+		bn, err := resolveBootNode(clusterDescFile, imageDir, mac)
+		candy.Must(err)
+		w.Header().Set("Content-Type", "text/plain")
+		candy.Must(ipxeScriptTmpl.Execute(w, struct {
+			KernelURL  string
+			InitrdURL  string
+			KernelArgs string
+		}{
+			KernelURL:  "/kernel/" + mac,
+			InitrdURL:  "/initrd/" + mac,
+			KernelArgs: bn.Node.KernelArgs,
+		}))
+	})
+}
+
+// makeKernelHandler streams the kernel image declared by the node
+// matching the MAC in the URL, via the CAS so nodes sharing an image
+// only ever store it once.
+func makeKernelHandler(clusterDescFile, imageDir string, cas *cache.CAS) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		mac := strings.ToLower(mux.Vars(r)["mac"])
+		bn, err := resolveBootNode(clusterDescFile, imageDir, mac)
+		candy.Must(err)
+		b, err := casFile(cas, bn.Node.Image+"/vmlinuz", bn.KernelPath)
+		candy.Must(err)
+		w.Write(b)
+	})
+}
+
+// makeInitrdHandler streams the initrd image declared by the node
+// matching the MAC in the URL, via the CAS so nodes sharing an image
+// only ever store it once.
+func makeInitrdHandler(clusterDescFile, imageDir string, cas *cache.CAS) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		mac := strings.ToLower(mux.Vars(r)["mac"])
+		bn, err := resolveBootNode(clusterDescFile, imageDir, mac)
+		candy.Must(err)
+		b, err := casFile(cas, bn.Node.Image+"/initrd.img", bn.InitrdPath)
+		candy.Must(err)
+		w.Write(b)
+	})
+}
+
+// casFile returns name's bytes from cas, populating cas from diskPath
+// the first time name is requested.
+func casFile(cas *cache.CAS, name, diskPath string) ([]byte, error) {
+	if b, ok, err := cas.GetByName(name); err != nil {
+		return nil, err
+	} else if ok {
+		return b, nil
+	}
+	b, err := ioutil.ReadFile(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cas.Put(name, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// isohybridMBRPaths lists the locations distros install the isolinux
+// hybrid MBR template (isohdpfx.bin) under.
+var isohybridMBRPaths = []string{
+	"/usr/lib/ISOLINUX/isohdpfx.bin",
+	"/usr/lib/syslinux/isohdpfx.bin",
+	"/usr/share/syslinux/isohdpfx.bin",
+}
+
+// findIsohybridMBR locates the isolinux hybrid MBR template that
+// xorriso's -isohybrid-mbr expects; it is a real 432-byte MBR boot
+// sector, not the EFI image grub-mkstandalone produces.
+func findIsohybridMBR() (string, error) {
+	for _, p := range isohybridMBRPaths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("isohybrid MBR template not found in %v (install isolinux/syslinux)", isohybridMBRPaths)
+}
+
+// buildEFIBootImg packs grubEfi, the GRUB EFI standalone binary, into
+// a small FAT image at the path UEFI firmware looks for
+// (EFI/BOOT/BOOTX64.EFI), for use as an El Torito EFI boot entry.
+func buildEFIBootImg(dir, grubEfi string) (string, error) {
+	efiImg := path.Join(dir, "efiboot.img")
+	if err := run("dd", "if=/dev/zero", "of="+efiImg, "bs=1M", "count=4"); err != nil {
+		return "", err
+	}
+	if err := run("mkfs.vfat", efiImg); err != nil {
+		return "", err
+	}
+	if err := run("mmd", "-i", efiImg, "::EFI", "::EFI/BOOT"); err != nil {
+		return "", err
+	}
+	if err := run("mcopy", "-i", efiImg, grubEfi, "::EFI/BOOT/BOOTX64.EFI"); err != nil {
+		return "", err
+	}
+	return efiImg, nil
+}
+
+// makeISOHandler builds a hybrid, USB-bootable ISO embedding the
+// node's kernel, initrd and rendered cloud-config, and streams it.
+// The ISO is assembled on the fly with grub-mkstandalone, mkfs.vfat,
+// mtools and xorriso, so those tools (plus an isolinux/syslinux install for the
+// isohybrid MBR template) must be on PATH.
+func makeISOHandler(clusterDescFile, ccTemplateDir, imageDir, hostTemplateDir string, store secrets.Store) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		mac := strings.ToLower(mux.Vars(r)["mac"])
+		bn, err := resolveBootNode(clusterDescFile, imageDir, mac)
+		candy.Must(err)
+
+		mbrPath, err := findIsohybridMBR()
+		candy.Must(err)
+
+		isoDir, err := ioutil.TempDir("", "sextant-iso")
+		candy.Must(err)
+		defer os.RemoveAll(isoDir)
+
+		var cc bytes.Buffer
+		candy.Must(cctemplate.Execute(&cc, mac, "cc-template", ccTemplateDir, clusterDescFile, hostTemplateDir, store))
+		candy.Must(ioutil.WriteFile(path.Join(isoDir, "config.yaml"), cc.Bytes(), 0644))
+		candy.Must(copyFile(bn.KernelPath, path.Join(isoDir, "vmlinuz")))
+		candy.Must(copyFile(bn.InitrdPath, path.Join(isoDir, "initrd.img")))
+
+		grubCfg, err := os.Create(path.Join(isoDir, "grub.cfg"))
+		candy.Must(err)
+		candy.Must(grubCfgTmpl.Execute(grubCfg, struct{ KernelArgs string }{bn.Node.KernelArgs}))
+		candy.Must(grubCfg.Close())
+
+		grubEfi := path.Join(isoDir, "bootx64.efi")
+		candy.Must(run("grub-mkstandalone", "-O", "x86_64-efi", "-o", grubEfi,
+			"boot/grub/grub.cfg="+path.Join(isoDir, "grub.cfg")))
+
+		efiImg, err := buildEFIBootImg(isoDir, grubEfi)
+		candy.Must(err)
+
+		isoPath := path.Join(isoDir, mac+".iso")
+		candy.Must(run("xorriso", "-as", "mkisofs",
+			"-isohybrid-mbr", mbrPath,
+			"-e", filepath.Base(efiImg),
+			"-no-emul-boot",
+			"-isohybrid-gpt-basdat",
+			"-o", isoPath, isoDir))
+
+		glog.Infof("serving generated ISO for mac %s", mac)
+		http.ServeFile(w, r, isoPath)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
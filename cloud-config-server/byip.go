@@ -0,0 +1,61 @@
+package main
+
+// Once a node is running (rather than iPXE-booting, where the MAC can
+// be templated into the request URL), it fetches its own cloud-config
+// by plain HTTP, carrying neither a MAC path variable nor any other
+// self-reported identity. This file resolves such requests by the
+// source IP instead, optionally trusting X-Forwarded-For when sextant
+// sits behind a proxy or load balancer.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/k8sp/sextant/cloud-config-server/cache"
+	"github.com/k8sp/sextant/cloud-config-server/secrets"
+	"github.com/topicai/candy"
+)
+
+// clientIP returns the IP sextant should identify r's sender by: the
+// first entry of X-Forwarded-For when trustXFF is set and the header
+// is present, otherwise r.RemoteAddr's host part. It takes nothing but
+// the request, so any handler can use it; today only the IP-based
+// /cloud-config handler does, and the boot-artifact handlers identify
+// the node by their {mac} path variable alone.
+func clientIP(r *http.Request, trustXFF bool) string {
+	if trustXFF {
+		if xff := r.Header.Get("X-Forwarded-For"); len(xff) > 0 {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// makeCloudConfigByIPHandler generates an HTTP handler serving
+// cloud-config to whichever node in clusterDescFile matches the
+// requester's IP. Unlike makeCloudConfigHandler, it carries no {mac}
+// path variable, so it can be fetched by a running node that only
+// knows its own IP. Requests from unrecognized IPs are denied with
+// 403 and logged.
+func makeCloudConfigByIPHandler(clusterDescFile, ccTemplateDir, hostTemplateDir string, store secrets.Store, cas *cache.CAS, trustXFF bool) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trustXFF)
+		c, err := loadCluster(clusterDescFile)
+		candy.Must(err)
+		n, ok := c.NodeByIP(ip)
+		if !ok {
+			glog.Warningf("denied cloud-config request from unknown IP %s", ip)
+			http.Error(w, "unknown node IP "+ip, http.StatusForbidden)
+			return
+		}
+		b, err := renderCloudConfig(cas, n.Mac(), ccTemplateDir, clusterDescFile, hostTemplateDir, store)
+		candy.Must(err)
+		w.Write(b)
+	})
+}
@@ -0,0 +1,163 @@
+// Package cache implements a small content-addressable store (CAS)
+// for cloud-config-server: every fetched upstream file (kernel,
+// initrd, image layer) and every rendered cloud-config is written
+// under <dir>/blobs/<sha256> exactly once, with a small JSON index
+// mapping a logical name (an image path, a rendered-config cache key)
+// to the hash of its current content. Identical inputs, however many
+// logical names point at them, are stored on disk once.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CAS is a content-addressable blob store rooted at Dir.
+type CAS struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// New returns a CAS rooted at dir, creating it if necessary.
+func New(dir string) *CAS {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		panic(err)
+	}
+	return &CAS{Dir: dir}
+}
+
+func (c *CAS) blobPath(hash string) string {
+	return filepath.Join(c.Dir, "blobs", hash)
+}
+
+func (c *CAS) indexPath() string {
+	return filepath.Join(c.Dir, "index.json")
+}
+
+// loadIndex and saveIndex must be called with c.mu held.
+
+func (c *CAS) loadIndex() (map[string]string, error) {
+	b, err := ioutil.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]string{}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (c *CAS) saveIndex(index map[string]string) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.indexPath(), b, 0644)
+}
+
+// Hash returns the content hash Put would store b under.
+func Hash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put stores b under its content hash (writing the blob only if it
+// isn't already present) and records name -> hash in the index, so a
+// later GetByName(name) resolves to it. It returns the hash.
+func (c *CAS) Put(name string, b []byte) (string, error) {
+	hash := Hash(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := os.Stat(c.blobPath(hash)); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(c.blobPath(hash), b, 0644); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	index, err := c.loadIndex()
+	if err != nil {
+		return "", err
+	}
+	index[name] = hash
+	return hash, c.saveIndex(index)
+}
+
+// GetByHash returns the blob stored under hash.
+func (c *CAS) GetByHash(hash string) ([]byte, error) {
+	return ioutil.ReadFile(c.blobPath(hash))
+}
+
+// GetByName resolves name to its current hash via the index and
+// returns its blob. ok is false if name isn't in the index.
+func (c *CAS) GetByName(name string) (b []byte, ok bool, err error) {
+	c.mu.Lock()
+	index, err := c.loadIndex()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	hash, found := index[name]
+	if !found {
+		return nil, false, nil
+	}
+	b, err = c.GetByHash(hash)
+	return b, err == nil, err
+}
+
+// Clean removes every blob unreferenced by any name in keep, but only
+// once it's older than maxAge -- a freshly-written blob whose index
+// entry hasn't been updated yet (or that's about to be) is left
+// alone. Each call resets the modification time of every kept blob,
+// so a blob's age counts from when it was written or last kept, i.e.
+// how long it has gone unreferenced. It's meant to be run
+// periodically by a background cleaner.
+func (c *CAS) Clean(keep map[string]bool, maxAge time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	index, err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+	keepHash := make(map[string]bool, len(keep))
+	for name, hash := range index {
+		if keep[name] {
+			keepHash[hash] = true
+		}
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(c.Dir, "blobs"))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if keepHash[e.Name()] {
+			if err := os.Chtimes(c.blobPath(e.Name()), now, now); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if now.Sub(e.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(c.blobPath(e.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
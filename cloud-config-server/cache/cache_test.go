@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPutGetByName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sextant-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New(dir)
+	want := []byte("hello world")
+	hash, err := c.Put("greeting", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != Hash(want) {
+		t.Fatalf("Put returned hash %s, want %s", hash, Hash(want))
+	}
+
+	got, ok, err := c.GetByName("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("GetByName(\"greeting\") reported not found")
+	}
+	if string(got) != string(want) {
+		t.Fatalf("GetByName returned %q, want %q", got, want)
+	}
+
+	if _, ok, err := c.GetByName("nonexistent"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("GetByName(\"nonexistent\") reported found")
+	}
+}
+
+func TestPutDeduplicatesIdenticalContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sextant-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New(dir)
+	b := []byte("same bytes")
+	if _, err := c.Put("a", b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put("b", b); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d blobs for two names pointing at identical content, want 1", len(entries))
+	}
+}
+
+func TestCleanKeepsReferencedAndFreshBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sextant-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New(dir)
+	keptHash, err := c.Put("kept", []byte("kept content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleHash, err := c.Put("stale", []byte("stale content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	freshHash, err := c.Put("fresh-unreferenced", []byte("fresh content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Backdate the kept and stale blobs so they're eligible for
+	// removal by age; only the keep set should save "kept".
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(c.blobPath(keptHash), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(c.blobPath(staleHash), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Clean(map[string]bool{"kept": true}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(c.blobPath(keptHash)); err != nil {
+		t.Errorf("kept blob was removed: %v", err)
+	}
+	if _, err := os.Stat(c.blobPath(staleHash)); !os.IsNotExist(err) {
+		t.Errorf("stale unreferenced blob survived Clean: err=%v", err)
+	}
+	if _, err := os.Stat(c.blobPath(freshHash)); err != nil {
+		t.Errorf("fresh unreferenced blob (younger than maxAge) was removed: %v", err)
+	}
+}
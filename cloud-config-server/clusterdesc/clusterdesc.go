@@ -0,0 +1,211 @@
+// Package clusterdesc defines the schema of cluster-desc.yml, the YAML
+// file that describes a k8s cluster's nodes and cluster-wide settings
+// for the cloud-config-server templates.
+package clusterdesc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Cluster is the root of cluster-desc.yml.
+type Cluster struct {
+	FlannelBackend    string                 `yaml:"flannel_backend"`
+	SSHAuthorizedKeys []string               `yaml:"ssh_authorized_keys"`
+	Vars              map[string]interface{} `yaml:"vars"`
+	Groups            []Group                `yaml:"groups"`
+	Nodes             []Node                 `yaml:"nodes"`
+}
+
+// Group carries vars and template names shared by every node that
+// references it by name, so a cluster-desc.yml with many similar
+// nodes doesn't have to repeat them on each one.
+type Group struct {
+	Name              string                 `yaml:"name"`
+	Vars              map[string]interface{} `yaml:"vars"`
+	ConfigTemplate    string                 `yaml:"config_template"`
+	StaticPodTemplate string                 `yaml:"static_pod_template"`
+}
+
+// Node describes a single cluster member.
+type Node struct {
+	MacAddr    string `yaml:"mac"`
+	Hostname   string `yaml:"hostname"`
+	IP         string `yaml:"ip"`
+	EtcdMember bool   `yaml:"etcd_member"`
+	KubeMaster bool   `yaml:"kube_master"`
+
+	// Image names the boot image (under --image-dir) this node should
+	// PXE/ISO boot into, and KernelArgs is appended to its kernel
+	// command line.
+	Image      string `yaml:"image"`
+	KernelArgs string `yaml:"kernel_args"`
+
+	// Group names a Group this node belongs to; the group's Vars are
+	// merged under the node's own Vars when building the render
+	// context (see Cluster.MergedVars).
+	Group string                 `yaml:"group"`
+	Vars  map[string]interface{} `yaml:"vars"`
+
+	// HostTemplate names an entry in a HostTemplates set that this
+	// stanza should be materialized from: any field left zero here is
+	// filled in from the template, while MacAddr/Hostname/IP set here
+	// override it. See Cluster.Materialize.
+	HostTemplate string `yaml:"host_template"`
+}
+
+// Mac returns the node's MAC address, normalized to lower case so it
+// can be compared with the {mac} path variable extracted from request
+// URLs.
+func (n Node) Mac() string {
+	return strings.ToLower(n.MacAddr)
+}
+
+// NodeByMac returns the node whose MAC matches mac (case-insensitively)
+// and whether it was found.
+func (c *Cluster) NodeByMac(mac string) (*Node, bool) {
+	mac = strings.ToLower(mac)
+	for i := range c.Nodes {
+		if c.Nodes[i].Mac() == mac {
+			return &c.Nodes[i], true
+		}
+	}
+	return nil, false
+}
+
+// NodeByIP returns the node whose declared IP matches ip and whether
+// it was found. Used to identify a node once it's running and fetches
+// its own cloud-config, when the request can no longer carry the MAC
+// the way iPXE-templated URLs do.
+func (c *Cluster) NodeByIP(ip string) (*Node, bool) {
+	for i := range c.Nodes {
+		if c.Nodes[i].IP == ip {
+			return &c.Nodes[i], true
+		}
+	}
+	return nil, false
+}
+
+// NodeByHostname returns the node whose Hostname matches name and
+// whether it was found.
+func (c *Cluster) NodeByHostname(name string) (*Node, bool) {
+	for i := range c.Nodes {
+		if c.Nodes[i].Hostname == name {
+			return &c.Nodes[i], true
+		}
+	}
+	return nil, false
+}
+
+// GroupByName returns the group named name and whether it was found.
+func (c *Cluster) GroupByName(name string) (*Group, bool) {
+	for i := range c.Groups {
+		if c.Groups[i].Name == name {
+			return &c.Groups[i], true
+		}
+	}
+	return nil, false
+}
+
+// MergedVars merges vars three deep -- cluster, then n's group (if
+// any), then n itself -- so a more specific level always wins. The
+// result is the render context cctemplate.Execute passes to a node's
+// config/static-pod templates.
+func (c *Cluster) MergedVars(n *Node) map[string]interface{} {
+	merged := mergeVars(nil, c.Vars)
+	if n.Group != "" {
+		if g, ok := c.GroupByName(n.Group); ok {
+			merged = mergeVars(merged, g.Vars)
+		}
+	}
+	return mergeVars(merged, n.Vars)
+}
+
+func mergeVars(base, overlay map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overlay))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overlay {
+		merged[k] = v
+	}
+	return merged
+}
+
+// HostTemplates is a set of partially-filled Node stanzas, keyed by
+// name, that a cluster-desc.yml node can materialize from via its
+// HostTemplate field plus a handful of overrides. This is how a
+// 50-node cluster can be described without a 50-entry node list: most
+// fields live once in the template, and each node stanza only states
+// what makes it unique (mac, hostname, ip).
+type HostTemplates map[string]Node
+
+// LoadHostTemplates reads every *.yml file in dir as a named host
+// template, using each file's basename (without extension) as its
+// name.
+func LoadHostTemplates(dir string) (HostTemplates, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	templates := make(HostTemplates, len(matches))
+	for _, fn := range matches {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		var n Node
+		if err := yaml.Unmarshal(b, &n); err != nil {
+			return nil, fmt.Errorf("parsing host template %s: %v", fn, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+		templates[name] = n
+	}
+	return templates, nil
+}
+
+// Materialize fills in any zero-valued field of n from the host
+// template it names, with n's own non-zero fields taking precedence
+// over the template's, and n's Vars merged on top of the template's
+// rather than discarded.
+func (c *Cluster) Materialize(n Node, templates HostTemplates) (Node, error) {
+	if n.HostTemplate == "" {
+		return n, nil
+	}
+	tmpl, ok := templates[n.HostTemplate]
+	if !ok {
+		return Node{}, fmt.Errorf("unknown host template %q", n.HostTemplate)
+	}
+	out := tmpl
+	if n.MacAddr != "" {
+		out.MacAddr = n.MacAddr
+	}
+	if n.Hostname != "" {
+		out.Hostname = n.Hostname
+	}
+	if n.IP != "" {
+		out.IP = n.IP
+	}
+	if n.EtcdMember {
+		out.EtcdMember = n.EtcdMember
+	}
+	if n.KubeMaster {
+		out.KubeMaster = n.KubeMaster
+	}
+	if n.Image != "" {
+		out.Image = n.Image
+	}
+	if n.KernelArgs != "" {
+		out.KernelArgs = n.KernelArgs
+	}
+	if n.Group != "" {
+		out.Group = n.Group
+	}
+	out.Vars = mergeVars(tmpl.Vars, n.Vars)
+	out.HostTemplate = n.HostTemplate
+	return out, nil
+}
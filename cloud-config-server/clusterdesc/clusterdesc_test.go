@@ -0,0 +1,68 @@
+package clusterdesc
+
+import "testing"
+
+func TestMaterializePreservesTemplateAndNodeOverrides(t *testing.T) {
+	templates := HostTemplates{
+		"worker": Node{
+			Image:      "coreos-stable",
+			KernelArgs: "console=ttyS0",
+			EtcdMember: true,
+			Group:      "workers",
+			Vars:       map[string]interface{}{"role": "worker", "disk": "sda"},
+		},
+	}
+
+	n := Node{
+		MacAddr:      "AA:BB:CC:DD:EE:FF",
+		Hostname:     "node1",
+		IP:           "10.0.0.1",
+		HostTemplate: "worker",
+		KubeMaster:   true,
+		Vars:         map[string]interface{}{"disk": "sdb"},
+	}
+
+	c := &Cluster{}
+	out, err := c.Materialize(n, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.MacAddr != n.MacAddr || out.Hostname != n.Hostname || out.IP != n.IP {
+		t.Fatalf("node-unique fields not preserved: %+v", out)
+	}
+	if out.Image != "coreos-stable" || out.KernelArgs != "console=ttyS0" {
+		t.Fatalf("template fields not inherited: %+v", out)
+	}
+	if !out.EtcdMember {
+		t.Fatal("template's EtcdMember was dropped")
+	}
+	if !out.KubeMaster {
+		t.Fatal("node's own KubeMaster was dropped")
+	}
+	if out.Group != "workers" {
+		t.Fatalf("template's Group was dropped: got %q", out.Group)
+	}
+	if out.Vars["role"] != "worker" {
+		t.Fatalf("template var not inherited: %+v", out.Vars)
+	}
+	if out.Vars["disk"] != "sdb" {
+		t.Fatalf("node var didn't override template var: %+v", out.Vars)
+	}
+}
+
+func TestMaterializeNodeGroupOverridesTemplate(t *testing.T) {
+	templates := HostTemplates{
+		"worker": Node{Group: "workers"},
+	}
+	n := Node{HostTemplate: "worker", Group: "special"}
+
+	c := &Cluster{}
+	out, err := c.Materialize(n, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Group != "special" {
+		t.Fatalf("node's Group override was dropped: got %q", out.Group)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+// Rendered cloud-configs are expensive to produce (they walk the
+// cluster-desc, the template dir and the secrets store) but, for a
+// given MAC, deterministic in those inputs. renderCloudConfig keys the
+// CAS by a hash of (template dir, cluster-desc, MAC, secrets store)
+// so a request that hits the cache never re-executes the template
+// pipeline, and exposes the rendered bytes for direct download by PXE
+// clients under /cas/{sha256}.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/k8sp/sextant/cloud-config-server/cache"
+	"github.com/k8sp/sextant/cloud-config-server/secrets"
+	cctemplate "github.com/k8sp/sextant/cloud-config-server/template"
+	"github.com/topicai/candy"
+)
+
+// renderCloudConfig returns mac's rendered cloud-config, serving it
+// straight out of cas when the (template dir, cluster-desc, mac,
+// secrets) inputs match a previous render.
+func renderCloudConfig(cas *cache.CAS, mac, ccTemplateDir, clusterDescFile, hostTemplateDir string, store secrets.Store) ([]byte, error) {
+	inputs, err := hashRenderInputs(ccTemplateDir, clusterDescFile, hostTemplateDir, store)
+	if err != nil {
+		return nil, err
+	}
+	key := inputs.key(mac)
+	if b, ok, err := cas.GetByName(key); err != nil {
+		return nil, err
+	} else if ok {
+		return b, nil
+	}
+
+	var cc bytes.Buffer
+	if err := cctemplate.Execute(&cc, mac, "cc-template", ccTemplateDir, clusterDescFile, hostTemplateDir, store); err != nil {
+		return nil, err
+	}
+	if _, err := cas.Put(key, cc.Bytes()); err != nil {
+		return nil, err
+	}
+	return cc.Bytes(), nil
+}
+
+// renderInputs holds the hashes of every render input that doesn't
+// vary per node -- the template dirs, the cluster-desc file and the
+// secrets store -- so casCleaner can compute one node's key without
+// re-walking any of them.
+type renderInputs struct {
+	tmplHash     string
+	hostTmplHash string
+	descHash     [sha256.Size]byte
+	secretsHash  string
+}
+
+// hashRenderInputs hashes the template dir's contents, the host
+// template dir's contents, the cluster-desc file's contents and the
+// secrets store's fingerprint, so any change to one of them changes
+// every node's render cache key.
+func hashRenderInputs(ccTemplateDir, clusterDescFile, hostTemplateDir string, store secrets.Store) (renderInputs, error) {
+	tmplHash, err := hashDir(ccTemplateDir)
+	if err != nil {
+		return renderInputs{}, err
+	}
+	hostTmplHash := ""
+	if hostTemplateDir != "" {
+		hostTmplHash, err = hashDir(hostTemplateDir)
+		if err != nil {
+			return renderInputs{}, err
+		}
+	}
+	descBytes, err := ioutil.ReadFile(clusterDescFile)
+	if err != nil {
+		return renderInputs{}, err
+	}
+	secretsHash, err := store.Fingerprint()
+	if err != nil {
+		return renderInputs{}, err
+	}
+	return renderInputs{
+		tmplHash:     tmplHash,
+		hostTmplHash: hostTmplHash,
+		descHash:     sha256.Sum256(descBytes),
+		secretsHash:  secretsHash,
+	}, nil
+}
+
+// key combines the shared render inputs with mac into the render
+// cache key for that one node.
+func (in renderInputs) key(mac string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%x\n%s\n%s\n", in.tmplHash, in.hostTmplHash, in.descHash, mac, in.secretsHash)
+	return "cloud-config:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// hashDir hashes every regular file's path, size and mtime under dir,
+// giving a cheap fingerprint that changes whenever a template is
+// added, edited or removed.
+func hashDir(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// casCleaner periodically drops CAS blobs no longer referenced by
+// clusterDescFile's current nodes, once they've gone unreferenced for
+// at least ttl (see cache.CAS.Clean). The
+// keep set is built from the same logical names the boot-artifact and
+// render-cache writers use -- <image>/vmlinuz, <image>/initrd.img and
+// each node's current render-cache key -- so a live kernel/initrd or
+// still-valid rendered config is never swept just because it's older
+// than ttl. It's meant to be launched as a goroutine from main and
+// never returns.
+func casCleaner(cas *cache.CAS, clusterDescFile, ccTemplateDir, hostTemplateDir string, store secrets.Store, ttl, interval time.Duration) {
+	for range time.Tick(interval) {
+		c, err := loadCluster(clusterDescFile)
+		if err != nil {
+			glog.Warningf("cas cleaner: loading %s: %v", clusterDescFile, err)
+			continue
+		}
+		inputs, err := hashRenderInputs(ccTemplateDir, clusterDescFile, hostTemplateDir, store)
+		if err != nil {
+			glog.Warningf("cas cleaner: hashing render inputs: %v", err)
+			continue
+		}
+		keep := make(map[string]bool)
+		for _, n := range c.Nodes {
+			keep[n.Image+"/vmlinuz"] = true
+			keep[n.Image+"/initrd.img"] = true
+			keep[inputs.key(n.Mac())] = true
+		}
+		if err := cas.Clean(keep, ttl); err != nil {
+			glog.Warningf("cas cleaner: %v", err)
+		}
+	}
+}
+
+// makeCASHandler serves a blob directly by its content hash, for
+// clients that already know the hash of a kernel/initrd or rendered
+// config stored in the CAS. The iPXE script does not use it: it points
+// at /kernel/{mac} and /initrd/{mac}.
+func makeCASHandler(cas *cache.CAS) http.HandlerFunc {
+	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
+		b, err := cas.GetByHash(mux.Vars(r)["sha256"])
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		candy.Must(err)
+		w.Write(b)
+	})
+}
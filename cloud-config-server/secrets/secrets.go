@@ -0,0 +1,364 @@
+// Package secrets stores per-cluster secret material -- CAs, signed
+// leaf certs, bootstrap tokens, passwords and SSH host keys -- so that
+// cloud-config templates can request them by name instead of
+// operators shipping bare --ca-crt/--ca-key files. Material is
+// generated lazily: the first request for a given (cluster, name)
+// tuple creates and persists it, later requests just read it back, so
+// a cloud-config re-rendered after a reboot is byte-identical.
+package secrets
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store is the interface cloud-config templates are wired against.
+// FSStore is the only implementation today; Vault- or etcd-backed
+// stores can satisfy the same interface later.
+type Store interface {
+	CAKey(cluster, name string) ([]byte, error)
+	CACrt(cluster, name string) ([]byte, error)
+	SignedCert(cluster, ca, cn, profile, spec string) (certPEM, keyPEM []byte, err error)
+	Token(cluster, name string) (string, error)
+	Password(cluster, name string) (string, error)
+	SSHHostKey(cluster, name string) ([]byte, error)
+
+	// ListCACerts and ListTokens back the admin API's read-only
+	// /api/clusters/{name}/cas and /api/clusters/{name}/tokens
+	// endpoints: every CA cert (never a key) and token already
+	// generated for cluster, keyed by name.
+	ListCACerts(cluster string) (map[string]string, error)
+	ListTokens(cluster string) (map[string]string, error)
+
+	// Fingerprint summarizes the store's current contents as a short
+	// hash that changes whenever any secret is added, rotated or
+	// removed. cloud-config-server's render cache folds this into its
+	// cache key, since a rendered cloud-config can embed any secret
+	// the store holds.
+	Fingerprint() (string, error)
+}
+
+// FSStore persists secrets as files under Dir, one file per (cluster,
+// kind, name) tuple.
+type FSStore struct {
+	Dir string
+}
+
+// NewFSStore returns a Store rooted at dir, creating it if necessary.
+func NewFSStore(dir string) *FSStore {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	return &FSStore{Dir: dir}
+}
+
+func (s *FSStore) path(cluster, kind, name string) string {
+	return filepath.Join(s.Dir, cluster, kind, name)
+}
+
+// cached returns the bytes stored at path, generating and persisting
+// them via gen on first use.
+func (s *FSStore) cached(path string, gen func() ([]byte, error)) ([]byte, error) {
+	if b, err := ioutil.ReadFile(path); err == nil {
+		return b, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	b, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// CAKey returns the PEM-encoded private key of the named CA,
+// generating a fresh self-signed CA the first time it's requested.
+func (s *FSStore) CAKey(cluster, name string) ([]byte, error) {
+	key, _, err := s.ca(cluster, name)
+	return key, err
+}
+
+// CACrt returns the PEM-encoded certificate of the named CA,
+// generating it alongside the key on first use.
+func (s *FSStore) CACrt(cluster, name string) ([]byte, error) {
+	_, crt, err := s.ca(cluster, name)
+	return crt, err
+}
+
+func (s *FSStore) ca(cluster, name string) (keyPEM, crtPEM []byte, err error) {
+	keyPath := s.path(cluster, "ca", name+"-key.pem")
+	crtPath := s.path(cluster, "ca", name+".pem")
+	key, kerr := ioutil.ReadFile(keyPath)
+	crt, cerr := ioutil.ReadFile(crtPath)
+	if kerr == nil && cerr == nil {
+		return key, crt, nil
+	}
+
+	key, crt, err = genSelfSignedCA(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, key, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(crtPath, crt, 0600); err != nil {
+		return nil, nil, err
+	}
+	return key, crt, nil
+}
+
+func genSelfSignedCA(cn string) (keyPEM, crtPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	crtPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return keyPEM, crtPEM, nil
+}
+
+// certSpec is the cfssl-style CSR spec accepted by SignedCert, e.g.
+// `{"hosts": ["10.0.0.1", "etcd0"]}`.
+type certSpec struct {
+	Hosts []string `json:"hosts"`
+}
+
+// SignedCert returns a PEM cert+key pair for cn, signed by the named
+// CA (generating the CA first if needed) with Subject Alternative
+// Names taken from spec's "hosts". The cache file name folds in ca
+// and a hash of spec, alongside profile, so cn/profile pairs signed
+// by a different CA or with different SANs get their own cert
+// instead of silently reusing whatever was cached first.
+func (s *FSStore) SignedCert(cluster, ca, cn, profile, spec string) (certPEM, keyPEM []byte, err error) {
+	specHash := sha256.Sum256([]byte(spec))
+	name := fmt.Sprintf("%s-%s-%s-%s", cn, profile, ca, hex.EncodeToString(specHash[:])[:8])
+	crtPath := s.path(cluster, "cert", name+".pem")
+	keyPath := s.path(cluster, "cert", name+"-key.pem")
+	if crt, err1 := ioutil.ReadFile(crtPath); err1 == nil {
+		if key, err2 := ioutil.ReadFile(keyPath); err2 == nil {
+			return crt, key, nil
+		}
+	}
+
+	var cs certSpec
+	if len(spec) > 0 {
+		if err := json.Unmarshal([]byte(spec), &cs); err != nil {
+			return nil, nil, fmt.Errorf("parsing cert spec for %s: %v", cn, err)
+		}
+	}
+
+	caKeyPEM, caCrtPEM, err := s.ca(cluster, ca)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKey, err := parseRSAKey(caKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	caCrt, err := parseCert(caCrtPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(5, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range cs.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCrt, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if err := os.MkdirAll(filepath.Dir(crtPath), 0700); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(crtPath, certPEM, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Token returns a random bootstrap/service-account token, generated
+// once per (cluster, name) and cached thereafter.
+func (s *FSStore) Token(cluster, name string) (string, error) {
+	b, err := s.cached(s.path(cluster, "token", name), func() ([]byte, error) { return randomHex(16) })
+	return string(b), err
+}
+
+// Password returns a random admin/basic-auth password, generated once
+// per (cluster, name) and cached thereafter.
+func (s *FSStore) Password(cluster, name string) (string, error) {
+	b, err := s.cached(s.path(cluster, "password", name), func() ([]byte, error) { return randomHex(12) })
+	return string(b), err
+}
+
+// SSHHostKey returns a PEM-encoded RSA SSH host key, generated once
+// per (cluster, name) and cached thereafter.
+func (s *FSStore) SSHHostKey(cluster, name string) ([]byte, error) {
+	return s.cached(s.path(cluster, "ssh-host-key", name+"-key.pem"), func() ([]byte, error) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	})
+}
+
+// ListCACerts returns every CA cert already generated for cluster,
+// keyed by CA name. It never returns key material.
+func (s *FSStore) ListCACerts(cluster string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.Dir, cluster, "ca"))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	certs := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pem") || strings.HasSuffix(e.Name(), "-key.pem") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.Dir, cluster, "ca", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		certs[strings.TrimSuffix(e.Name(), ".pem")] = string(b)
+	}
+	return certs, nil
+}
+
+// ListTokens returns every bootstrap/service-account token already
+// generated for cluster, keyed by token name.
+func (s *FSStore) ListTokens(cluster string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.Dir, cluster, "token"))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.Dir, cluster, "token", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tokens[e.Name()] = string(b)
+	}
+	return tokens, nil
+}
+
+// Fingerprint walks the store and hashes every (path, size, mtime)
+// triple it finds, so the result changes whenever a secret is added,
+// rotated or removed.
+func (s *FSStore) Fingerprint() (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func randomHex(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func parseRSAKey(p []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(p)
+	if block == nil {
+		return nil, errors.New("invalid PEM key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func parseCert(p []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(p)
+	if block == nil {
+		return nil, errors.New("invalid PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,116 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *FSStore {
+	dir, err := ioutil.TempDir("", "sextant-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return NewFSStore(dir)
+}
+
+func TestTokenLazyGenerateThenStable(t *testing.T) {
+	s := newTestStore(t)
+	first, err := s.Token("mycluster", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == "" {
+		t.Fatal("Token returned empty string")
+	}
+	second, err := s.Token("mycluster", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatalf("Token regenerated on second call: %q != %q", first, second)
+	}
+}
+
+func TestCACrtLazyGenerateThenStable(t *testing.T) {
+	s := newTestStore(t)
+	crt1, err := s.CACrt("mycluster", "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt2, err := s.CACrt("mycluster", "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(crt1) != string(crt2) {
+		t.Fatal("CACrt regenerated a new CA on second call")
+	}
+
+	// A differently-named CA in the same cluster must be independent.
+	other, err := s.CACrt("mycluster", "kube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(other) == string(crt1) {
+		t.Fatal("CACrt returned the same cert for two different CA names")
+	}
+}
+
+func TestSignedCertCachesPerCAAndSpec(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.CACrt("mycluster", "etcd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CACrt("mycluster", "kube"); err != nil {
+		t.Fatal(err)
+	}
+
+	crt1, _, err := s.SignedCert("mycluster", "etcd", "node1", "server", `{"hosts":["10.0.0.1"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt1Again, _, err := s.SignedCert("mycluster", "etcd", "node1", "server", `{"hosts":["10.0.0.1"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(crt1) != string(crt1Again) {
+		t.Fatal("SignedCert regenerated an identical request")
+	}
+
+	// Same cn/profile, different CA: must not reuse the first cert.
+	crtDifferentCA, _, err := s.SignedCert("mycluster", "kube", "node1", "server", `{"hosts":["10.0.0.1"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(crtDifferentCA) == string(crt1) {
+		t.Fatal("SignedCert reused the cached cert for a different signing CA")
+	}
+
+	// Same cn/profile/CA, different SANs: must not reuse the first cert.
+	crtDifferentSpec, _, err := s.SignedCert("mycluster", "etcd", "node1", "server", `{"hosts":["10.0.0.2"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(crtDifferentSpec) == string(crt1) {
+		t.Fatal("SignedCert reused the cached cert for a different spec")
+	}
+}
+
+func TestFingerprintChangesOnNewSecret(t *testing.T) {
+	s := newTestStore(t)
+	before, err := s.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Token("mycluster", "bootstrap"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := s.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatal("Fingerprint didn't change after a new secret was generated")
+	}
+}
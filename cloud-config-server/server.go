@@ -17,15 +17,15 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"path"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
 	"github.com/gorilla/mux"
 	"github.com/k8sp/sextant/cloud-config-server/cache"
-	"github.com/k8sp/sextant/cloud-config-server/certgen"
 	"github.com/k8sp/sextant/cloud-config-server/clusterdesc"
+	"github.com/k8sp/sextant/cloud-config-server/secrets"
 	cctemplate "github.com/k8sp/sextant/cloud-config-server/template"
 	"github.com/topicai/candy"
 	"gopkg.in/yaml.v2"
@@ -34,25 +34,26 @@ import (
 func main() {
 	clusterDesc := flag.String("cluster-desc", "./cluster-desc.yml", "Configurations for a k8s cluster.")
 	ccTemplateDir := flag.String("cloud-config-dir", "./cloud-config.template", "cloud-config file template.")
-	caCrt := flag.String("ca-crt", "", "CA certificate file, in PEM format")
-	caKey := flag.String("ca-key", "", "CA private key file, in PEM format")
+	secretsDir := flag.String("secrets-dir", "./secrets/", "Directory used to persist lazily-generated cluster secrets: CAs, signed certs, tokens, passwords and SSH host keys.")
 	addr := flag.String("addr", ":8080", "Listening address")
 	staticDir := flag.String("dir", "./static/", "The directory to serve files from. Default is ./static/")
+	imageDir := flag.String("image-dir", "./images/", "Directory holding per-image kernel/initrd pairs, named <image-dir>/<node-image>/{vmlinuz,initrd.img}.")
+	trustXFF := flag.Bool("trust-xff", false, "Trust the X-Forwarded-For header when identifying a node by IP. Only enable this behind a trusted proxy/load balancer.")
+	hostTemplateDir := flag.String("host-template-dir", "", "Directory of named host templates (YAML Node stanzas) a node can materialize from via its host_template field.")
+	apiToken := flag.String("api-token", "", "Bearer token required by the /api/ admin surface. Leave empty to disable the admin API.")
+	casDir := flag.String("cas-dir", "./cas/", "Content-addressable store directory for fetched boot artifacts and rendered cloud-configs.")
+	casTTL := flag.Duration("cas-ttl", 24*time.Hour, "How long a CAS blob may sit unreferenced by cluster-desc before the cleaner removes it.")
 	validate := flag.Bool("validate", false, "Validate cluster-desc.yaml and the generated cloud-config file.")
 	flag.Parse()
 
-	if len(*caCrt) == 0 || len(*caKey) == 0 {
-		glog.Info("No ca.pem or ca-key.pem provided, generating now...")
-		*caKey, *caCrt = certgen.GenerateRootCA("./")
-	}
-	// valid caKey and caCrt file is ready
-	candy.Must(fileExist(*caCrt))
-	candy.Must(fileExist(*caKey))
+	store := secrets.NewFSStore(*secretsDir)
+	cas := cache.New(*casDir)
+	go casCleaner(cas, *clusterDesc, *ccTemplateDir, *hostTemplateDir, store, *casTTL, *casTTL/4)
 
 	// Validate cluster-desc.yaml, the generated cloud-config.yaml which generated by the mac in cluster-desc
 	if *validate == true {
 		glog.Info("Checking %s ...", *clusterDesc)
-		err := validation(*clusterDesc, *ccTemplateDir, *caKey, *caCrt, *staticDir)
+		err := validation(*clusterDesc, *ccTemplateDir, *hostTemplateDir, store, *staticDir)
 		if err != nil {
 			glog.Info("Failed: \n" + err.Error())
 			os.Exit(1)
@@ -66,14 +67,21 @@ func main() {
 
 	// start and run the HTTP server
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/cloud-config/{mac}", makeCloudConfigHandler(*clusterDesc, *ccTemplateDir, *caKey, *caCrt))
+	router.HandleFunc("/cloud-config/{mac}", makeCloudConfigHandler(*clusterDesc, *ccTemplateDir, *hostTemplateDir, store, cas))
+	router.HandleFunc("/cloud-config", makeCloudConfigByIPHandler(*clusterDesc, *ccTemplateDir, *hostTemplateDir, store, cas, *trustXFF))
+	router.HandleFunc("/ipxe/{mac}", makeIPXEHandler(*clusterDesc, *imageDir))
+	router.HandleFunc("/kernel/{mac}", makeKernelHandler(*clusterDesc, *imageDir, cas))
+	router.HandleFunc("/initrd/{mac}", makeInitrdHandler(*clusterDesc, *imageDir, cas))
+	router.HandleFunc("/iso/{mac}", makeISOHandler(*clusterDesc, *ccTemplateDir, *imageDir, *hostTemplateDir, store))
+	router.HandleFunc("/cas/{sha256}", makeCASHandler(cas))
+	registerAPIRoutes(router, *clusterDesc, *ccTemplateDir, *hostTemplateDir, store, *apiToken)
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(*staticDir))))
 
 	glog.Fatal(http.Serve(l, router))
 }
 
 // Validate cluster-desc.yaml and check the generated cloud-config file format.
-func validation(clusterDescFile string, ccTemplateDir string, caKey, caCrt, dir string) error {
+func validation(clusterDescFile string, ccTemplateDir string, hostTemplateDir string, store secrets.Store, dir string) error {
 	clusterDesc, err := ioutil.ReadFile(clusterDescFile)
 	candy.Must(err)
 	_, direrr := os.Stat(ccTemplateDir)
@@ -112,6 +120,28 @@ func validation(clusterDescFile string, ccTemplateDir string, caKey, caCrt, dir
 		return errors.New("Cluster description yaml should include one ssh key.")
 	}
 
+	var hostTemplates clusterdesc.HostTemplates
+	if hostTemplateDir != "" {
+		hostTemplates, err = clusterdesc.LoadHostTemplates(hostTemplateDir)
+		if err != nil {
+			return errors.New("loading host templates failed: " + err.Error())
+		}
+	}
+
+	// every group/host_template a node references must actually exist
+	for _, node := range c.Nodes {
+		if node.Group != "" {
+			if _, ok := c.GroupByName(node.Group); !ok {
+				return errors.New("node " + node.Hostname + " references unknown group " + node.Group)
+			}
+		}
+		if node.HostTemplate != "" {
+			if _, ok := hostTemplates[node.HostTemplate]; !ok {
+				return errors.New("node " + node.Hostname + " references unknown host template " + node.HostTemplate)
+			}
+		}
+	}
+
 	var ccTmplBuffer bytes.Buffer
 	var macList []string
 	macList = append(macList, "00:00:00:00:00:00")
@@ -120,7 +150,7 @@ func validation(clusterDescFile string, ccTemplateDir string, caKey, caCrt, dir
 	}
 	for _, mac := range macList {
 		//err = cctemplate.Execute(tmpl, c, mac, caKey, caCrt, &ccTmplBuffer)
-		err = cctemplate.Execute(&ccTmplBuffer, mac, "cc-template", ccTemplateDir, clusterDescFile, caKey, caCrt)
+		err = cctemplate.Execute(&ccTmplBuffer, mac, "cc-template", ccTemplateDir, clusterDescFile, hostTemplateDir, store)
 		if err != nil {
 			return errors.New("Generate cloud-config failed with mac: " + mac + "\n" + err.Error())
 		}
@@ -137,10 +167,12 @@ func validation(clusterDescFile string, ccTemplateDir string, caKey, caCrt, dir
 
 // makeCloudConfigHandler generate a HTTP server handler to serve cloud-config
 // fetching requests
-func makeCloudConfigHandler(clusterDescFile string, ccTemplateDir string, caKey, caCrt string) http.HandlerFunc {
+func makeCloudConfigHandler(clusterDescFile, ccTemplateDir, hostTemplateDir string, store secrets.Store, cas *cache.CAS) http.HandlerFunc {
 	return makeSafeHandler(func(w http.ResponseWriter, r *http.Request) {
 		mac := strings.ToLower(mux.Vars(r)["mac"])
-		candy.Must(cctemplate.Execute(w, mac, "cc-template", ccTemplateDir, clusterDescFile, caKey, caCrt))
+		b, err := renderCloudConfig(cas, mac, ccTemplateDir, clusterDescFile, hostTemplateDir, store)
+		candy.Must(err)
+		w.Write(b)
 	})
 }
 
@@ -154,21 +186,3 @@ func makeSafeHandler(h http.HandlerFunc) http.HandlerFunc {
 		h(w, r)
 	}
 }
-
-func makeCacheGetter(url, fn string) func() []byte {
-	if len(fn) == 0 {
-		dir, e := ioutil.TempDir("", "")
-		candy.Must(e)
-		fn = path.Join(dir, "localfile")
-	}
-	c := cache.New(url, fn)
-	return func() []byte { return c.Get() }
-}
-
-func fileExist(fn string) error {
-	_, err := os.Stat(fn)
-	if err != nil || os.IsNotExist(err) {
-		return errors.New("file " + fn + " is not ready.")
-	}
-	return nil
-}
@@ -0,0 +1,97 @@
+// Package template renders a node's cloud-config from the templates
+// in a cloud-config.template directory, making the parsed
+// cluster-desc.yml and a secrets.Store available to the template.
+package template
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"text/template"
+
+	"github.com/k8sp/sextant/cloud-config-server/clusterdesc"
+	"github.com/k8sp/sextant/cloud-config-server/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// certKeyPair is what the `signed_cert` template func returns, so
+// templates can pull out `.Cert` and `.Key` separately.
+type certKeyPair struct {
+	Cert string
+	Key  string
+}
+
+// Execute renders tmplName, looked up among the templates parsed from
+// tmplDir, into w. The rendered context is clusterDescFile's parsed
+// YAML, plus a "Mac" field set to mac and a "Vars" field holding mac's
+// node's vars merged three deep (cluster -> group -> host, see
+// clusterdesc.Cluster.MergedVars). If the node names a host_template
+// and hostTemplateDir is non-empty, it's materialized from that
+// template before vars are merged. store backs the ca_key, ca_crt,
+// signed_cert, token, password and ssh_host_key template funcs.
+func Execute(w io.Writer, mac, tmplName, tmplDir, clusterDescFile, hostTemplateDir string, store secrets.Store) error {
+	b, err := ioutil.ReadFile(clusterDescFile)
+	if err != nil {
+		return err
+	}
+	ctx := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(b, ctx); err != nil {
+		return err
+	}
+	ctx["Mac"] = mac
+
+	cluster := &clusterdesc.Cluster{}
+	if err := yaml.Unmarshal(b, cluster); err != nil {
+		return err
+	}
+	if n, ok := cluster.NodeByMac(mac); ok {
+		if hostTemplateDir != "" && n.HostTemplate != "" {
+			templates, err := clusterdesc.LoadHostTemplates(hostTemplateDir)
+			if err != nil {
+				return err
+			}
+			materialized, err := cluster.Materialize(*n, templates)
+			if err != nil {
+				return err
+			}
+			n = &materialized
+		}
+		ctx["Vars"] = cluster.MergedVars(n)
+	}
+
+	tmpl, err := template.New(filepath.Base(tmplDir)).Funcs(funcMap(store)).ParseGlob(filepath.Join(tmplDir, "*"))
+	if err != nil {
+		return err
+	}
+	return tmpl.ExecuteTemplate(w, tmplName, ctx)
+}
+
+// funcMap exposes store's secret material to cloud-config templates,
+// e.g. `{{ca_key "mycluster" "root"}}` or
+// `{{$cert := signed_cert "mycluster" "root" "etcd0" "etcd-peer" "{\"hosts\":[\"10.0.0.1\"]}"}}{{$cert.Cert}}`.
+func funcMap(store secrets.Store) template.FuncMap {
+	return template.FuncMap{
+		"ca_key": func(cluster, name string) (string, error) {
+			b, err := store.CAKey(cluster, name)
+			return string(b), err
+		},
+		"ca_crt": func(cluster, name string) (string, error) {
+			b, err := store.CACrt(cluster, name)
+			return string(b), err
+		},
+		"signed_cert": func(cluster, ca, cn, profile, spec string) (certKeyPair, error) {
+			crt, key, err := store.SignedCert(cluster, ca, cn, profile, spec)
+			return certKeyPair{Cert: string(crt), Key: string(key)}, err
+		},
+		"token": func(cluster, name string) (string, error) {
+			return store.Token(cluster, name)
+		},
+		"password": func(cluster, name string) (string, error) {
+			return store.Password(cluster, name)
+		},
+		"ssh_host_key": func(cluster, name string) (string, error) {
+			b, err := store.SSHHostKey(cluster, name)
+			return string(b), err
+		},
+	}
+}